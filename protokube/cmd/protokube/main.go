@@ -0,0 +1,144 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/kops/protokube/pkg/protokube"
+)
+
+func main() {
+	cloud := flag.String("cloud", "aws", "cloud provider to use for volume discovery (aws, iscsi)")
+	iscsiManifest := flag.String("iscsi-manifest", "", "path to the volume manifest used by the iscsi cloud provider")
+	volumeDefaultTags := flag.String("volume-default-tags", "", "comma-separated key=value tags applied to every etcd volume we attach")
+	volumeTagsDryRun := flag.Bool("volume-tags-dry-run", false, "log tag changes instead of applying them")
+	volumeAttachTimeout := flag.Duration("volume-attach-timeout", protokube.DefaultAttachTimeout, "how long to wait for a volume to attach before giving up")
+	flag.Parse()
+
+	if *iscsiManifest != "" {
+		protokube.SetISCSIManifestPath(*iscsiManifest)
+	}
+
+	defaultTags, err := parseTags(*volumeDefaultTags)
+	if err != nil {
+		glog.Errorf("invalid --volume-default-tags: %v", err)
+		os.Exit(1)
+	}
+
+	volumes, err := protokube.NewVolumes(*cloud, protokube.VolumeConfig{
+		ReconcileDryRun: *volumeTagsDryRun,
+		AttachTimeout:   *volumeAttachTimeout,
+	})
+	if err != nil {
+		glog.Errorf("error initializing volumes provider %q: %v", *cloud, err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	for {
+		if err := attachMasterVolumes(ctx, volumes, defaultTags); err != nil {
+			glog.Warningf("error attaching master volumes: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// parseTags parses a comma-separated key=value list, as accepted by --volume-default-tags
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	if s == "" {
+		return tags, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected key=value", pair)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
+// attachMasterVolumes finds the etcd data volumes belonging to this master, attaches any that
+// are not yet attached to this instance, and reconciles cluster/default/etcd tags onto each one
+func attachMasterVolumes(ctx context.Context, volumes protokube.Volumes, defaultTags map[string]string) error {
+	found, err := volumes.FindVolumes()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range found {
+		if v.LocalDevice == "" {
+			if err := volumes.AttachVolume(ctx, v); err != nil {
+				glog.Warningf("error attaching volume %q: %v", v.ID, err)
+				continue
+			}
+			glog.Infof("attached volume %q as %q", v.ID, v.LocalDevice)
+		}
+
+		if err := volumes.ReconcileTags(v, desiredVolumeTags(volumes, v, defaultTags)); err != nil {
+			glog.Warningf("error reconciling tags on volume %q: %v", v.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// desiredVolumeTags computes the union of the cluster tag, the configured default tags, and the
+// volume's own etcd-cluster tags, mirroring the "volume_tags" / default-tag-inheritance pattern
+// used by Terraform's aws_instance resource.
+func desiredVolumeTags(volumes protokube.Volumes, v *protokube.Volume, defaultTags map[string]string) map[string]string {
+	desired := map[string]string{
+		protokube.TagNameKubernetesCluster: volumes.ClusterID(),
+	}
+
+	for k, val := range defaultTags {
+		desired[k] = val
+	}
+
+	for _, spec := range v.Info.EtcdClusters {
+		value := spec.NodeName
+		if len(spec.NodeNames) > 0 {
+			value += "/" + strings.Join(spec.NodeNames, ",")
+		}
+		desired[protokube.TagNameEtcdClusterPrefix+spec.ClusterKey] = value
+	}
+
+	return desired
+}
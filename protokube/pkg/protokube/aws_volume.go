@@ -17,14 +17,21 @@ limitations under the License.
 package protokube
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/golang/glog"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -41,28 +48,68 @@ const TagNameEtcdClusterPrefix = "k8s.io/etcd/"
 
 const TagNameMasterId = "k8s.io/master/id"
 
+// Suffixes appended to TagNameEtcdClusterPrefix + <cluster> to request a particular
+// EBS volume type/IOPS/throughput at volume-creation time, e.g.
+// "k8s.io/etcd/main/volume-type" = "gp3".
+const (
+	VolumeTagSuffixType        = "volume-type"
+	VolumeTagSuffixIOPS        = "iops"
+	VolumeTagSuffixThroughput  = "throughput"
+	VolumeTagSuffixMultiAttach = "multi-attach"
+)
+
 //const DefaultAttachDevice = "/dev/xvdb"
 
-var devices = []string{"/dev/xvdu", "/dev/xvdv", "/dev/xvdx", "/dev/xvdx", "/dev/xvdy", "/dev/xvdz"}
+// devices is the candidate pool of device names we hand out in assignDevice. It mirrors the
+// generator used by the Kubernetes AWS cloud provider (ba..bz, ca..cz) rather than the old
+// fixed xvdu..xvdz range, so clusters with many etcd/event volumes don't exhaust the pool.
+var devices = generateDeviceList()
+
+func generateDeviceList() []string {
+	var list []string
+	for _, first := range []byte{'b', 'c'} {
+		for second := byte('a'); second <= 'z'; second++ {
+			list = append(list, fmt.Sprintf("/dev/xvd%c%c", first, second))
+		}
+	}
+	return list
+}
 
 type AWSVolumes struct {
-	ec2      *ec2.EC2
+	// ec2 is an interface, rather than *ec2.EC2, so that tests can substitute a fake client
+	ec2      ec2iface.EC2API
 	metadata *ec2metadata.EC2Metadata
 
-	zone       string
-	clusterTag string
-	instanceId string
-	internalIP net.IP
+	zone         string
+	clusterTag   string
+	instanceId   string
+	instanceType string
+	internalIP   net.IP
+
+	mutex            sync.Mutex
+	deviceMap        map[string]string
+	inFlightAttaches map[string]bool
+
+	describeMutex   sync.Mutex
+	describeCache   map[string]*Volume
+	describeCacheAt time.Time
 
-	mutex     sync.Mutex
-	deviceMap map[string]string
+	// AttachTimeout overrides DefaultAttachTimeout when non-zero; set from VolumeConfig at
+	// construction time (also handy for tests to override directly).
+	AttachTimeout time.Duration
+
+	// reconcileDryRun makes ReconcileTags log what it would change instead of applying it;
+	// set from VolumeConfig at construction time.
+	reconcileDryRun bool
 }
 
 var _ Volumes = &AWSVolumes{}
 
-func NewAWSVolumes() (*AWSVolumes, error) {
+func NewAWSVolumes(volumeConfig VolumeConfig) (*AWSVolumes, error) {
 	a := &AWSVolumes{
-		deviceMap: make(map[string]string),
+		deviceMap:       make(map[string]string),
+		AttachTimeout:   volumeConfig.AttachTimeout,
+		reconcileDryRun: volumeConfig.ReconcileDryRun,
 	}
 
 	s := session.New()
@@ -71,8 +118,8 @@ func NewAWSVolumes() (*AWSVolumes, error) {
 		glog.V(4).Infof("AWS API Request: %s/%s", r.ClientInfo.ServiceName, r.Operation.Name)
 	})
 
-	config := aws.NewConfig()
-	a.metadata = ec2metadata.New(s, config)
+	awsConfig := aws.NewConfig()
+	a.metadata = ec2metadata.New(s, awsConfig)
 
 	region, err := a.metadata.Region()
 	if err != nil {
@@ -89,7 +136,7 @@ func NewAWSVolumes() (*AWSVolumes, error) {
 		return nil, fmt.Errorf("error querying ec2 metadata service (for instance-id): %v", err)
 	}
 
-	a.ec2 = ec2.New(s, config.WithRegion(region))
+	a.ec2 = ec2.New(s, awsConfig.WithRegion(region))
 
 	err = a.discoverTags()
 	if err != nil {
@@ -125,6 +172,8 @@ func (a *AWSVolumes) discoverTags() error {
 
 	a.clusterTag = clusterID
 
+	a.instanceType = aws.StringValue(instance.InstanceType)
+
 	a.internalIP = net.ParseIP(aws.StringValue(instance.PrivateIpAddress))
 	if a.internalIP == nil {
 		return fmt.Errorf("Internal IP not found on this instance (%q)", a.instanceId)
@@ -175,16 +224,30 @@ func (a *AWSVolumes) findVolumes(request *ec2.DescribeVolumesInput) ([]*Volume,
 				ID: volumeID,
 				Info: VolumeInfo{
 					Description: volumeID,
+					VolumeType:  aws.StringValue(v.VolumeType),
+					IOPS:        aws.Int64Value(v.Iops),
+					Throughput:  aws.Int64Value(v.Throughput),
 				},
 			}
+			vol.VolumeType = aws.StringValue(v.VolumeType)
+			vol.Info.MultiAttach = aws.BoolValue(v.MultiAttachEnabled)
+
 			state := aws.StringValue(v.State)
 
 			vol.Status = state
 
 			for _, attachment := range v.Attachments {
-				vol.AttachedTo = aws.StringValue(attachment.InstanceId)
-				if aws.StringValue(attachment.InstanceId) == a.instanceId {
-					vol.LocalDevice = aws.StringValue(attachment.Device)
+				instanceID := aws.StringValue(attachment.InstanceId)
+				vol.AttachedTo = instanceID
+				vol.AttachedToMultiple = append(vol.AttachedToMultiple, instanceID)
+				if instanceID == a.instanceId {
+					device := aws.StringValue(attachment.Device)
+					if nvmeDevice, err := nvmeDeviceForVolume(volumeID); err != nil {
+						glog.V(2).Infof("error resolving nvme device for volume %q: %v", volumeID, err)
+					} else if nvmeDevice != "" {
+						device = nvmeDevice
+					}
+					vol.LocalDevice = device
 				}
 			}
 
@@ -207,7 +270,54 @@ func (a *AWSVolumes) findVolumes(request *ec2.DescribeVolumesInput) ([]*Volume,
 					}
 				default:
 					if strings.HasPrefix(k, TagNameEtcdClusterPrefix) {
-						etcdClusterName := k[len(TagNameEtcdClusterPrefix):]
+						remainder := k[len(TagNameEtcdClusterPrefix):]
+
+						// Tags of the form k8s.io/etcd/<cluster>/volume-type|iops|throughput
+						// are volume-creation hints, not etcd cluster membership specs.
+						if parts := strings.SplitN(remainder, "/", 2); len(parts) == 2 {
+							switch parts[1] {
+							case VolumeTagSuffixType:
+								// A hint can only fill in what the describe response didn't
+								// already tell us, never override the volume's true, live type.
+								if vol.Info.VolumeType == "" {
+									vol.Info.VolumeType = v
+									vol.VolumeType = v
+								}
+							case VolumeTagSuffixIOPS:
+								if vol.Info.IOPS == 0 {
+									iops, err := strconv.ParseInt(v, 10, 64)
+									if err != nil {
+										glog.Warningf("error parsing iops tag on volume %q %s=%s; skipping volume", volumeID, k, v)
+										skipVolume = true
+									} else {
+										vol.Info.IOPS = iops
+									}
+								}
+							case VolumeTagSuffixThroughput:
+								if vol.Info.Throughput == 0 {
+									throughput, err := strconv.ParseInt(v, 10, 64)
+									if err != nil {
+										glog.Warningf("error parsing throughput tag on volume %q %s=%s; skipping volume", volumeID, k, v)
+										skipVolume = true
+									} else {
+										vol.Info.Throughput = throughput
+									}
+								}
+							case VolumeTagSuffixMultiAttach:
+								multiAttach, err := strconv.ParseBool(v)
+								if err != nil {
+									glog.Warningf("error parsing multi-attach tag on volume %q %s=%s; skipping volume", volumeID, k, v)
+									skipVolume = true
+								} else {
+									vol.Info.MultiAttach = vol.Info.MultiAttach && multiAttach
+								}
+							default:
+								glog.Warningf("unknown tag on volume %q: %s=%s", volumeID, k, v)
+							}
+							continue
+						}
+
+						etcdClusterName := remainder
 						spec, err := ParseEtcdClusterSpec(etcdClusterName, v)
 						if err != nil {
 							// Fail safe
@@ -272,16 +382,98 @@ func (a *AWSVolumes) assignDevice(volumeID string) (string, error) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	// TODO: Check for actual devices in use (like cloudprovider does)
+	inUse, err := devicesInUse()
+	if err != nil {
+		// If we can't determine what the kernel actually has in use, log and fall back to
+		// the deviceMap check alone; a device the kernel already has may then be handed out.
+		glog.Warningf("error probing in-use block devices, falling back to deviceMap only: %v", err)
+	}
+
 	for _, d := range devices {
-		if a.deviceMap[d] == "" {
-			a.deviceMap[d] = volumeID
-			return d, nil
+		if a.deviceMap[d] != "" {
+			continue
 		}
+		if inUse[d] {
+			continue
+		}
+		a.deviceMap[d] = volumeID
+		return d, nil
 	}
 	return "", fmt.Errorf("All devices in use")
 }
 
+// devicesInUse enumerates /sys/block to find devices already in use by the kernel (whether
+// from the OS image or an out-of-band attachment), so that assignDevice doesn't hand out a
+// device letter that's already occupied even though our in-memory deviceMap thinks it's free.
+func devicesInUse() (map[string]bool, error) {
+	inUse := make(map[string]bool)
+
+	entries, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return inUse, nil
+		}
+		return nil, fmt.Errorf("error reading /sys/block: %v", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasPrefix(name, "xvd"):
+			inUse["/dev/"+name] = true
+		case strings.HasPrefix(name, "nvme"):
+			// Nitro instances present EBS volumes as /dev/nvme?n1 rather than under the
+			// requested /dev/xvd* name, so there's no xvd* entry under /sys/block for them
+			// at all to mark as in-use here. We could in principle go the other direction -
+			// given an nvme device, ask the controller (via the NVMe identify admin command,
+			// which surfaces the requested name in a vendor-specific extension of the
+			// response) which xvd* name it was requested under - but decoding that
+			// vendor-specific payload correctly requires matching AWS's own struct layout
+			// exactly, and getting it wrong risks silently misreading memory rather than
+			// just missing a collision. nvmeDeviceForVolume (the direction we actually rely
+			// on, matching a known volume ID against a controller's serial number) doesn't
+			// have this problem, since the serial number is a well-documented plain string.
+			// So: an xvd* letter collision against a device that's only visible as an nvme
+			// device won't be caught here, and assignDevice can hand out a letter for a
+			// device that's already in use under its nvme identity. This matches the
+			// behavior of the upstream in-tree AWS cloud provider's device allocator.
+			inUse["/dev/"+name] = true
+		}
+	}
+
+	return inUse, nil
+}
+
+// nvmeDeviceForVolume resolves the EBS volume ID (e.g. "vol-0123456789abcdef0") to the actual
+// kernel device path (e.g. "/dev/nvme1n1") by matching against the NVMe controller's serial
+// number, which AWS sets to the volume ID with the "vol-" dash removed. This is required on
+// Nitro-based instance types, where EBS volumes are exposed as NVMe devices rather than under
+// the requested /dev/xvd* name.
+func nvmeDeviceForVolume(volumeID string) (string, error) {
+	controllers, err := ioutil.ReadDir("/sys/class/nvme")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error reading /sys/class/nvme: %v", err)
+	}
+
+	wantSerial := strings.Replace(volumeID, "-", "", 1)
+
+	for _, controller := range controllers {
+		serialBytes, err := ioutil.ReadFile(filepath.Join("/sys/class/nvme", controller.Name(), "serial"))
+		if err != nil {
+			glog.V(2).Infof("error reading nvme serial for %q: %v", controller.Name(), err)
+			continue
+		}
+		if strings.TrimSpace(string(serialBytes)) == wantSerial {
+			return "/dev/" + controller.Name() + "n1", nil
+		}
+	}
+
+	return "", nil
+}
+
 // releaseDevice releases the volume mapping lock; used when an attach was known to fail
 func (a *AWSVolumes) releaseDevice(d string, volumeID string) {
 	a.mutex.Lock()
@@ -293,10 +485,50 @@ func (a *AWSVolumes) releaseDevice(d string, volumeID string) {
 	a.deviceMap[d] = ""
 }
 
-// AttachVolume attaches the specified volume to this instance, returning the mountpoint & nil if successful
-func (a *AWSVolumes) AttachVolume(volume *Volume) error {
+// snowVolumeTypes are the volume types only available on AWS Snowball Edge / Snowcone devices
+var snowVolumeTypes = map[string]bool{
+	"sbg1": true,
+	"sbp1": true,
+}
+
+// checkVolumeTypeCompatibility sanity-checks that volumeType makes sense for instanceType,
+// returning an error if the combination can never work, so that we fail fast instead of
+// spinning in AttachVolume until AWS eventually rejects the request.
+func checkVolumeTypeCompatibility(instanceType string, volumeType string) error {
+	if volumeType == "" {
+		return nil
+	}
+
+	isSnowInstance := strings.HasPrefix(instanceType, "snc1") || strings.Contains(instanceType, "snow")
+
+	if snowVolumeTypes[volumeType] && !isSnowInstance {
+		return fmt.Errorf("volume type %q is only supported on Snow family instances, not %q", volumeType, instanceType)
+	}
+	if !snowVolumeTypes[volumeType] && isSnowInstance {
+		return fmt.Errorf("instance type %q is a Snow family instance and requires a Snow volume type (sbg1/sbp1), not %q", instanceType, volumeType)
+	}
+
+	return nil
+}
+
+// DefaultAttachTimeout bounds how long AttachVolume will wait for a volume to reach the attached
+// state before giving up with ErrAttachTimeout.
+const DefaultAttachTimeout = 10 * time.Minute
+
+const maxAttachBackoff = 30 * time.Second
+
+// AttachVolume attaches the specified volume to this instance, setting volume.LocalDevice and
+// returning nil if successful. It polls with exponential backoff (capped at maxAttachBackoff, plus
+// jitter) rather than a fixed interval, gives up once either ctx is done or its attach timeout
+// (AttachTimeout if set, otherwise DefaultAttachTimeout) elapses,
+// and batches its status checks against every volume this AWSVolumes is currently attaching.
+func (a *AWSVolumes) AttachVolume(ctx context.Context, volume *Volume) error {
 	volumeID := volume.ID
 
+	if err := checkVolumeTypeCompatibility(a.instanceType, volume.VolumeType); err != nil {
+		return fmt.Errorf("cannot attach EBS volume %q to instance %q: %v", volumeID, a.instanceId, err)
+	}
+
 	device := volume.LocalDevice
 	if device == "" {
 		d, err := a.assignDevice(volumeID)
@@ -313,40 +545,54 @@ func (a *AWSVolumes) AttachVolume(volume *Volume) error {
 
 		attachResponse, err := a.ec2.AttachVolume(request)
 		if err != nil {
-			return fmt.Errorf("Error attaching EBS volume %q: %v", volumeID, err)
+			a.releaseDevice(device, volumeID)
+
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "VolumeInUse" {
+				return fmt.Errorf("%w: volume %q: %v", ErrVolumeInUse, volumeID, err)
+			}
+			return fmt.Errorf("error attaching EBS volume %q: %v", volumeID, err)
 		}
 
 		glog.V(2).Infof("AttachVolume request returned %v", attachResponse)
 	}
 
-	// Wait (forever) for volume to attach or reach a failure-to-attach condition
-	for {
-		request := &ec2.DescribeVolumesInput{
-			VolumeIds: []*string{&volumeID},
-		}
+	a.beginAttach(volumeID)
+	defer a.endAttach(volumeID)
+
+	deadline := time.Now().Add(a.attachTimeout())
+	backoff := time.Second
 
-		volumes, err := a.findVolumes(request)
+	for {
+		v, err := a.describeInFlightVolume(volumeID)
 		if err != nil {
-			return fmt.Errorf("Error describing EBS volume %q: %v", volumeID, err)
+			return fmt.Errorf("error describing EBS volume %q: %v", volumeID, err)
 		}
-
-		if len(volumes) == 0 {
+		if v == nil {
 			return fmt.Errorf("EBS volume %q disappeared during attach", volumeID)
 		}
-		if len(volumes) != 1 {
-			return fmt.Errorf("Multiple volumes found with id %q", volumeID)
-		}
 
-		v := volumes[0]
-		if v.AttachedTo != "" {
+		if v.Info.MultiAttach {
+			// io2 Multi-Attach volumes can be attached to more than one instance in the
+			// same AZ at once, so each attachment is an independent record: we only care
+			// whether *we* are in the list, not whether anyone else is. Callers are
+			// responsible for fencing I/O (e.g. at the etcd layer) themselves.
+			for _, instanceID := range v.AttachedToMultiple {
+				if instanceID == a.instanceId {
+					// v.LocalDevice is whatever FindVolumes/describeInFlightVolume just
+					// resolved it to (the NVMe path on Nitro instances); device is only the
+					// xvd letter we originally requested, which may not exist in the kernel.
+					volume.LocalDevice = v.LocalDevice
+					return nil
+				}
+			}
+		} else if v.AttachedTo != "" {
 			if v.AttachedTo == a.instanceId {
-				volume.LocalDevice = device
+				volume.LocalDevice = v.LocalDevice
 				return nil
-			} else {
-				a.releaseDevice(device, volumeID)
-
-				return fmt.Errorf("Unable to attach volume %q, was attached to %q", volumeID, v.AttachedTo)
 			}
+
+			a.releaseDevice(device, volumeID)
+			return fmt.Errorf("%w: volume %q is attached to %q", ErrAlreadyAttachedElsewhere, volumeID, v.AttachedTo)
 		}
 
 		switch v.Status {
@@ -355,9 +601,179 @@ func (a *AWSVolumes) AttachVolume(volume *Volume) error {
 		// continue looping
 
 		default:
-			return fmt.Errorf("Observed unexpected volume state %q", v.Status)
+			a.releaseDevice(device, volumeID)
+			return fmt.Errorf("observed unexpected volume state %q for volume %q", v.Status, volumeID)
+		}
+
+		if time.Now().After(deadline) {
+			a.releaseDevice(device, volumeID)
+			return fmt.Errorf("%w: volume %q, after %s", ErrAttachTimeout, volumeID, a.attachTimeout())
 		}
 
-		time.Sleep(10 * time.Second)
+		select {
+		case <-ctx.Done():
+			a.releaseDevice(device, volumeID)
+			return ctx.Err()
+		case <-time.After(withJitter(backoff)):
+		}
+
+		backoff *= 2
+		if backoff > maxAttachBackoff {
+			backoff = maxAttachBackoff
+		}
 	}
 }
+
+// withJitter returns d plus up to 20% random jitter, so that many instances backing off in
+// lockstep don't all re-poll the EC2 API in the same instant.
+func withJitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// attachTimeout returns a.AttachTimeout (set from VolumeConfig at construction time, or
+// overridden directly by tests) if non-zero, otherwise DefaultAttachTimeout.
+func (a *AWSVolumes) attachTimeout() time.Duration {
+	if a.AttachTimeout != 0 {
+		return a.AttachTimeout
+	}
+	return DefaultAttachTimeout
+}
+
+// beginAttach records that volumeID is now being actively attached, so that concurrent
+// AttachVolume calls batch it into their DescribeVolumes polling.
+func (a *AWSVolumes) beginAttach(volumeID string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.inFlightAttaches == nil {
+		a.inFlightAttaches = make(map[string]bool)
+	}
+	a.inFlightAttaches[volumeID] = true
+}
+
+func (a *AWSVolumes) endAttach(volumeID string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.inFlightAttaches, volumeID)
+}
+
+func (a *AWSVolumes) inFlightAttachIDs() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var ids []string
+	for id := range a.inFlightAttaches {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// describeInFlightVolume looks up volumeID's current state, batching the underlying
+// DescribeVolumes call against every volume this AWSVolumes is currently attaching (reusing a
+// very recent result instead of making a fresh call), to stay well under EC2 API rate limits on
+// clusters with many etcd/event volumes attaching at once.
+func (a *AWSVolumes) describeInFlightVolume(volumeID string) (*Volume, error) {
+	a.describeMutex.Lock()
+	defer a.describeMutex.Unlock()
+
+	if a.describeCache != nil && time.Since(a.describeCacheAt) < time.Second {
+		if v, ok := a.describeCache[volumeID]; ok {
+			return v, nil
+		}
+		// volumeID wasn't part of the batch that produced this cache (e.g. its attach only
+		// just started), so a miss here means nothing about whether the volume actually
+		// exists - fall through and describe it for real rather than reporting it gone.
+	}
+
+	ids := a.inFlightAttachIDs()
+	if len(ids) == 0 {
+		ids = []string{volumeID}
+	}
+
+	request := &ec2.DescribeVolumesInput{
+		VolumeIds: aws.StringSlice(ids),
+	}
+
+	volumes, err := a.findVolumes(request)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*Volume, len(volumes))
+	for _, v := range volumes {
+		byID[v.ID] = v
+	}
+
+	a.describeCache = byID
+	a.describeCacheAt = time.Now()
+
+	return byID[volumeID], nil
+}
+
+// ReconcileTags applies any tags in desired that aren't already present (with the same value)
+// on the EBS volume, via CreateTags. It never reads or removes the volume's existing tags beyond
+// that, so unrecognized tags set by other tooling are left alone.
+func (a *AWSVolumes) ReconcileTags(volume *Volume, desired map[string]string) error {
+	if len(desired) == 0 {
+		return nil
+	}
+
+	current, err := a.describeVolumeTags(volume.ID)
+	if err != nil {
+		return err
+	}
+
+	var missing []*ec2.Tag
+	for k, v := range desired {
+		if existing, ok := current[k]; ok && existing == v {
+			continue
+		}
+		missing = append(missing, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if a.reconcileDryRun {
+		glog.Infof("dry-run: would apply %d tag(s) to EBS volume %q: %v", len(missing), volume.ID, missing)
+		return nil
+	}
+
+	request := &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(volume.ID)},
+		Tags:      missing,
+	}
+	if _, err := a.ec2.CreateTags(request); err != nil {
+		return fmt.Errorf("error tagging EBS volume %q: %v", volume.ID, err)
+	}
+
+	return nil
+}
+
+func (a *AWSVolumes) describeVolumeTags(volumeID string) (map[string]string, error) {
+	request := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}
+
+	tags := make(map[string]string)
+	err := a.ec2.DescribeVolumesPages(request, func(p *ec2.DescribeVolumesOutput, lastPage bool) (shouldContinue bool) {
+		for _, v := range p.Volumes {
+			for _, tag := range v.Tags {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error describing tags for EBS volume %q: %v", volumeID, err)
+	}
+
+	return tags, nil
+}
+
+func init() {
+	RegisterVolumeProvider("aws", func(config VolumeConfig) (Volumes, error) {
+		return NewAWSVolumes(config)
+	})
+}
@@ -0,0 +1,364 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package protokube
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+const testInstanceID = "i-self"
+
+// fakeEC2 implements ec2iface.EC2API by embedding it (so unimplemented methods panic rather
+// than needing to be stubbed out) and overriding only the calls AWSVolumes actually makes.
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	mu                  sync.Mutex
+	describeVolumesFunc func(*ec2.DescribeVolumesInput) ([]*ec2.Volume, error)
+	attachVolumeFunc    func(*ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error)
+	createTagsCalls     []*ec2.CreateTagsInput
+}
+
+func (f *fakeEC2) DescribeVolumesPages(input *ec2.DescribeVolumesInput, fn func(*ec2.DescribeVolumesOutput, bool) bool) error {
+	volumes, err := f.describeVolumesFunc(input)
+	if err != nil {
+		return err
+	}
+	fn(&ec2.DescribeVolumesOutput{Volumes: volumes}, true)
+	return nil
+}
+
+func (f *fakeEC2) AttachVolume(input *ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error) {
+	return f.attachVolumeFunc(input)
+}
+
+func (f *fakeEC2) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	f.mu.Lock()
+	f.createTagsCalls = append(f.createTagsCalls, input)
+	f.mu.Unlock()
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// fakeVolume builds an *ec2.Volume in the shape findVolumes expects back from DescribeVolumes
+func fakeVolume(id, state string, attachedTo []string, multiAttach bool) *ec2.Volume {
+	vol := &ec2.Volume{
+		VolumeId:           aws.String(id),
+		State:              aws.String(state),
+		MultiAttachEnabled: aws.Bool(multiAttach),
+	}
+	for _, instanceID := range attachedTo {
+		vol.Attachments = append(vol.Attachments, &ec2.VolumeAttachment{
+			InstanceId: aws.String(instanceID),
+			Device:     aws.String("/dev/xvdba"),
+		})
+	}
+	return vol
+}
+
+// TestFindVolumesIgnoresStaleVolumeTypeHint guards against a volume-creation-hint tag
+// (k8s.io/etcd/<cluster>/volume-type) overriding the volume's real, already-provisioned
+// type/IOPS/throughput as reported by DescribeVolumes itself: the tag should only fill in
+// a field DescribeVolumes left empty, never override observed truth.
+func TestFindVolumesIgnoresStaleVolumeTypeHint(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			vol := fakeVolume("vol-1", "available", nil, false)
+			vol.VolumeType = aws.String("gp3")
+			vol.Iops = aws.Int64(3000)
+			vol.Throughput = aws.Int64(125)
+			vol.Tags = []*ec2.Tag{
+				{Key: aws.String("k8s.io/etcd/main/volume-type"), Value: aws.String("sbg1")},
+				{Key: aws.String("k8s.io/etcd/main/iops"), Value: aws.String("100")},
+				{Key: aws.String("k8s.io/etcd/main/throughput"), Value: aws.String("40")},
+			}
+			return []*ec2.Volume{vol}, nil
+		},
+	}
+	a := &AWSVolumes{ec2: fake}
+
+	volumes, err := a.FindVolumes()
+	if err != nil {
+		t.Fatalf("FindVolumes failed: %v", err)
+	}
+	if len(volumes) != 1 {
+		t.Fatalf("expected 1 volume, got %d", len(volumes))
+	}
+
+	v := volumes[0]
+	if v.VolumeType != "gp3" || v.Info.VolumeType != "gp3" {
+		t.Errorf("stale volume-type hint overrode the observed type: VolumeType=%q Info.VolumeType=%q", v.VolumeType, v.Info.VolumeType)
+	}
+	if v.Info.IOPS != 3000 {
+		t.Errorf("stale iops hint overrode the observed value: got %d", v.Info.IOPS)
+	}
+	if v.Info.Throughput != 125 {
+		t.Errorf("stale throughput hint overrode the observed value: got %d", v.Info.Throughput)
+	}
+}
+
+// TestFindVolumesFillsInMissingVolumeTypeHint verifies the hint is still honored when
+// DescribeVolumes doesn't already know the value (e.g. IOPS/Throughput aren't reported for
+// volume types that don't support them).
+func TestFindVolumesFillsInMissingVolumeTypeHint(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			vol := fakeVolume("vol-1", "available", nil, false)
+			vol.Tags = []*ec2.Tag{
+				{Key: aws.String("k8s.io/etcd/main/volume-type"), Value: aws.String("gp3")},
+				{Key: aws.String("k8s.io/etcd/main/iops"), Value: aws.String("3000")},
+				{Key: aws.String("k8s.io/etcd/main/throughput"), Value: aws.String("125")},
+			}
+			return []*ec2.Volume{vol}, nil
+		},
+	}
+	a := &AWSVolumes{ec2: fake}
+
+	volumes, err := a.FindVolumes()
+	if err != nil {
+		t.Fatalf("FindVolumes failed: %v", err)
+	}
+	if len(volumes) != 1 {
+		t.Fatalf("expected 1 volume, got %d", len(volumes))
+	}
+
+	v := volumes[0]
+	if v.VolumeType != "gp3" || v.Info.VolumeType != "gp3" {
+		t.Errorf("expected hint to fill in the missing type, got VolumeType=%q Info.VolumeType=%q", v.VolumeType, v.Info.VolumeType)
+	}
+	if v.Info.IOPS != 3000 {
+		t.Errorf("expected hint to fill in the missing iops, got %d", v.Info.IOPS)
+	}
+	if v.Info.Throughput != 125 {
+		t.Errorf("expected hint to fill in the missing throughput, got %d", v.Info.Throughput)
+	}
+}
+
+// testAWSVolumes builds an AWSVolumes wired to fake, ready for AttachVolume/ReconcileTags calls.
+// The returned deviceMap already reserves device for volumeID, matching what assignDevice would
+// have done, so the releaseDevice fail-safe path doesn't trip on an untracked device.
+func testAWSVolumes(fake *fakeEC2, volumeID, device string) *AWSVolumes {
+	return &AWSVolumes{
+		ec2:        fake,
+		instanceId: testInstanceID,
+		deviceMap:  map[string]string{device: volumeID},
+	}
+}
+
+func TestAttachVolumeSingleAttachSuccess(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			return []*ec2.Volume{fakeVolume("vol-1", "in-use", []string{testInstanceID}, false)}, nil
+		},
+	}
+	a := testAWSVolumes(fake, "vol-1", "/dev/xvdba")
+
+	volume := &Volume{ID: "vol-1", LocalDevice: "/dev/xvdba"}
+	if err := a.AttachVolume(context.Background(), volume); err != nil {
+		t.Fatalf("AttachVolume failed: %v", err)
+	}
+	if volume.LocalDevice != "/dev/xvdba" {
+		t.Errorf("expected LocalDevice %q, got %q", "/dev/xvdba", volume.LocalDevice)
+	}
+}
+
+func TestAttachVolumeMultiAttachSuccess(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			return []*ec2.Volume{fakeVolume("vol-1", "in-use", []string{"i-other", testInstanceID}, true)}, nil
+		},
+	}
+	a := testAWSVolumes(fake, "vol-1", "/dev/xvdba")
+
+	volume := &Volume{ID: "vol-1", LocalDevice: "/dev/xvdba", VolumeType: "io2"}
+	if err := a.AttachVolume(context.Background(), volume); err != nil {
+		t.Fatalf("AttachVolume failed: %v", err)
+	}
+}
+
+func TestAttachVolumeAlreadyAttachedElsewhere(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			return []*ec2.Volume{fakeVolume("vol-1", "in-use", []string{"i-other"}, false)}, nil
+		},
+	}
+	a := testAWSVolumes(fake, "vol-1", "/dev/xvdba")
+
+	volume := &Volume{ID: "vol-1", LocalDevice: "/dev/xvdba"}
+	err := a.AttachVolume(context.Background(), volume)
+	if !errors.Is(err, ErrAlreadyAttachedElsewhere) {
+		t.Fatalf("expected ErrAlreadyAttachedElsewhere, got %v", err)
+	}
+}
+
+func TestAttachVolumeBackoffThenSuccess(t *testing.T) {
+	var calls int
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			calls++
+			if calls < 2 {
+				return []*ec2.Volume{fakeVolume("vol-1", "attaching", nil, false)}, nil
+			}
+			return []*ec2.Volume{fakeVolume("vol-1", "in-use", []string{testInstanceID}, false)}, nil
+		},
+	}
+	a := testAWSVolumes(fake, "vol-1", "/dev/xvdba")
+	a.AttachTimeout = time.Minute
+
+	volume := &Volume{ID: "vol-1", LocalDevice: "/dev/xvdba"}
+	if err := a.AttachVolume(context.Background(), volume); err != nil {
+		t.Fatalf("AttachVolume failed: %v", err)
+	}
+	if calls < 2 {
+		t.Errorf("expected AttachVolume to poll more than once, only called DescribeVolumes %d time(s)", calls)
+	}
+}
+
+func TestAttachVolumeTimeout(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			return []*ec2.Volume{fakeVolume("vol-1", "attaching", nil, false)}, nil
+		},
+	}
+	a := testAWSVolumes(fake, "vol-1", "/dev/xvdba")
+	a.AttachTimeout = time.Nanosecond
+
+	volume := &Volume{ID: "vol-1", LocalDevice: "/dev/xvdba"}
+	err := a.AttachVolume(context.Background(), volume)
+	if !errors.Is(err, ErrAttachTimeout) {
+		t.Fatalf("expected ErrAttachTimeout, got %v", err)
+	}
+}
+
+func TestAttachVolumeContextCancelled(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			return []*ec2.Volume{fakeVolume("vol-1", "attaching", nil, false)}, nil
+		},
+	}
+	a := testAWSVolumes(fake, "vol-1", "/dev/xvdba")
+	a.AttachTimeout = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	volume := &Volume{ID: "vol-1", LocalDevice: "/dev/xvdba"}
+	if err := a.AttachVolume(ctx, volume); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// TestDescribeInFlightVolumeCacheMiss guards against the batched-describe cache being trusted
+// for a volume ID it didn't actually cover: if two volumes start attaching in the same second,
+// the second volume's first poll used to hit a cache built only for the first volume's ID set,
+// get a map miss, and misreport the volume as having disappeared (see AttachVolume's "disappeared
+// during attach" error). A miss must fall through to a fresh DescribeVolumes call instead.
+func TestDescribeInFlightVolumeCacheMiss(t *testing.T) {
+	var calls int
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			calls++
+			return []*ec2.Volume{fakeVolume("vol-b", "available", nil, false)}, nil
+		},
+	}
+	a := &AWSVolumes{ec2: fake, instanceId: testInstanceID}
+
+	// Simulate a cache populated moments ago by a different volume's batched poll.
+	a.describeCache = map[string]*Volume{"vol-a": {ID: "vol-a"}}
+	a.describeCacheAt = time.Now()
+
+	v, err := a.describeInFlightVolume("vol-b")
+	if err != nil {
+		t.Fatalf("describeInFlightVolume failed: %v", err)
+	}
+	if v == nil {
+		t.Fatalf("expected a fresh DescribeVolumes call on cache miss, got nil (volume misreported as disappeared)")
+	}
+	if calls != 1 {
+		t.Fatalf("expected exactly 1 DescribeVolumes call, got %d", calls)
+	}
+}
+
+func TestReconcileTagsAddsMissingTags(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			vol := fakeVolume("vol-1", "in-use", nil, false)
+			vol.Tags = []*ec2.Tag{{Key: aws.String("existing"), Value: aws.String("kept")}}
+			return []*ec2.Volume{vol}, nil
+		},
+	}
+	a := &AWSVolumes{ec2: fake}
+
+	err := a.ReconcileTags(&Volume{ID: "vol-1"}, map[string]string{
+		"existing": "kept",
+		"missing":  "added",
+	})
+	if err != nil {
+		t.Fatalf("ReconcileTags failed: %v", err)
+	}
+
+	if len(fake.createTagsCalls) != 1 {
+		t.Fatalf("expected exactly 1 CreateTags call, got %d", len(fake.createTagsCalls))
+	}
+	tags := fake.createTagsCalls[0].Tags
+	if len(tags) != 1 || aws.StringValue(tags[0].Key) != "missing" || aws.StringValue(tags[0].Value) != "added" {
+		t.Errorf("expected only the missing tag to be created, got %v", tags)
+	}
+}
+
+func TestReconcileTagsNoopWhenAlreadyPresent(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			vol := fakeVolume("vol-1", "in-use", nil, false)
+			vol.Tags = []*ec2.Tag{{Key: aws.String("existing"), Value: aws.String("kept")}}
+			return []*ec2.Volume{vol}, nil
+		},
+	}
+	a := &AWSVolumes{ec2: fake}
+
+	err := a.ReconcileTags(&Volume{ID: "vol-1"}, map[string]string{"existing": "kept"})
+	if err != nil {
+		t.Fatalf("ReconcileTags failed: %v", err)
+	}
+	if len(fake.createTagsCalls) != 0 {
+		t.Errorf("expected no CreateTags call when all desired tags already match, got %v", fake.createTagsCalls)
+	}
+}
+
+func TestReconcileTagsDryRunSkipsCreateTags(t *testing.T) {
+	fake := &fakeEC2{
+		describeVolumesFunc: func(input *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+			return []*ec2.Volume{fakeVolume("vol-1", "in-use", nil, false)}, nil
+		},
+	}
+	a := &AWSVolumes{ec2: fake, reconcileDryRun: true}
+
+	err := a.ReconcileTags(&Volume{ID: "vol-1"}, map[string]string{"missing": "added"})
+	if err != nil {
+		t.Fatalf("ReconcileTags failed: %v", err)
+	}
+	if len(fake.createTagsCalls) != 0 {
+		t.Errorf("expected dry-run to skip CreateTags, got %v", fake.createTagsCalls)
+	}
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package protokube
+
+import "errors"
+
+// ErrAttachTimeout is returned by AttachVolume when the volume did not reach an attached state
+// within the configured timeout. Callers can treat this differently from a hard failure, e.g.
+// by retrying with a fresh device letter.
+var ErrAttachTimeout = errors.New("timed out waiting for volume to attach")
+
+// ErrVolumeInUse is returned when the cloud rejects an attach request because the volume is
+// already attached elsewhere and cannot accept another attachment (e.g. AWS's VolumeInUse error).
+var ErrVolumeInUse = errors.New("volume is in use and cannot be attached")
+
+// ErrAlreadyAttachedElsewhere is returned when a volume that does not support multiple
+// attachments turns out to be attached to an instance other than this one.
+var ErrAlreadyAttachedElsewhere = errors.New("volume is already attached to a different instance")
@@ -0,0 +1,265 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package protokube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// execCommand is a var so tests can substitute a fake iscsiadm shim
+var execCommand = exec.Command
+
+// ISCSIVolumeEntry describes a single etcd data volume in an ISCSIVolumes manifest
+type ISCSIVolumeEntry struct {
+	VolumeID string `json:"volumeId"`
+	MasterID int    `json:"masterId"`
+
+	// EtcdClusters maps an etcd cluster key (e.g. "main", "events") to the tag-style value
+	// protokube already knows how to parse, e.g. "master-1/master-0,master-1,master-2"
+	EtcdClusters map[string]string `json:"etcdClusters"`
+
+	TargetPortal string `json:"targetPortal"`
+	TargetIQN    string `json:"targetIqn"`
+	LUN          int    `json:"lun"`
+}
+
+// ISCSIManifest is the discovery source consumed by ISCSIVolumes: the set of etcd volumes
+// this instance should consider, along with enough cluster identity to take the place of the
+// EC2 instance tags that AWSVolumes relies on.
+type ISCSIManifest struct {
+	ClusterID  string             `json:"clusterId"`
+	InternalIP string             `json:"internalIP"`
+	Volumes    []ISCSIVolumeEntry `json:"volumes"`
+}
+
+// iscsiManifestSource loads an ISCSIManifest from wherever it is configured to live. The
+// default implementation, fileManifestSource, reads a local JSON file (YAML is not parsed); a Consul or etcd KV-backed source can
+// implement the same interface without changing ISCSIVolumes itself.
+type iscsiManifestSource interface {
+	LoadManifest() (*ISCSIManifest, error)
+}
+
+// fileManifestSource reads the manifest from a local JSON file path
+type fileManifestSource struct {
+	path string
+}
+
+func (s *fileManifestSource) LoadManifest() (*ISCSIManifest, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading iscsi volume manifest %q: %v", s.path, err)
+	}
+
+	manifest := &ISCSIManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, fmt.Errorf("error parsing iscsi volume manifest %q: %v", s.path, err)
+	}
+	return manifest, nil
+}
+
+// ISCSIVolumes is a Volumes implementation for bare-metal / Snow / on-prem deployments where
+// EBS isn't available: etcd data volumes are presented over iSCSI and discovered from a
+// manifest rather than from cloud instance tags.
+type ISCSIVolumes struct {
+	source iscsiManifestSource
+
+	clusterID  string
+	internalIP net.IP
+
+	// attachTimeout bounds how long we wait for the by-path device to appear after login
+	attachTimeout time.Duration
+}
+
+var _ Volumes = &ISCSIVolumes{}
+
+// NewISCSIVolumes builds an ISCSIVolumes backend that discovers volumes from the manifest at manifestPath
+func NewISCSIVolumes(manifestPath string, volumeConfig VolumeConfig) (*ISCSIVolumes, error) {
+	attachTimeout := 30 * time.Second
+	if volumeConfig.AttachTimeout != 0 {
+		attachTimeout = volumeConfig.AttachTimeout
+	}
+
+	a := &ISCSIVolumes{
+		source:        &fileManifestSource{path: manifestPath},
+		attachTimeout: attachTimeout,
+	}
+
+	manifest, err := a.source.LoadManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.ClusterID == "" {
+		return nil, fmt.Errorf("iscsi volume manifest %q does not specify a clusterId", manifestPath)
+	}
+	a.clusterID = manifest.ClusterID
+
+	a.internalIP = net.ParseIP(manifest.InternalIP)
+	if a.internalIP == nil {
+		return nil, fmt.Errorf("iscsi volume manifest %q has invalid internalIP %q", manifestPath, manifest.InternalIP)
+	}
+
+	return a, nil
+}
+
+func (a *ISCSIVolumes) ClusterID() string {
+	return a.clusterID
+}
+
+func (a *ISCSIVolumes) InternalIP() net.IP {
+	return a.internalIP
+}
+
+// FindVolumes returns the volumes listed in the manifest, in the same shape AWSVolumes.FindVolumes returns
+func (a *ISCSIVolumes) FindVolumes() ([]*Volume, error) {
+	manifest, err := a.source.LoadManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []*Volume
+	for _, entry := range manifest.Volumes {
+		vol := &Volume{
+			ID: entry.VolumeID,
+			Info: VolumeInfo{
+				Description: entry.VolumeID,
+				MasterID:    entry.MasterID,
+			},
+		}
+
+		for clusterKey, spec := range entry.EtcdClusters {
+			parsed, err := ParseEtcdClusterSpec(clusterKey, spec)
+			if err != nil {
+				glog.Warningf("error parsing etcd cluster spec %q for volume %q; skipping volume: %v", spec, entry.VolumeID, err)
+				vol = nil
+				break
+			}
+			vol.Info.EtcdClusters = append(vol.Info.EtcdClusters, parsed)
+		}
+		if vol == nil {
+			continue
+		}
+
+		devicePath := iscsiByPathDevice(entry)
+		if _, err := os.Stat(devicePath); err == nil {
+			vol.LocalDevice = devicePath
+			vol.AttachedTo = "self"
+			vol.Status = "in-use"
+		} else {
+			vol.Status = "available"
+		}
+
+		volumes = append(volumes, vol)
+	}
+
+	return volumes, nil
+}
+
+// ReconcileTags is a no-op for ISCSIVolumes: on-prem/Snow volumes aren't backed by a cloud API
+// with a tagging concept, so there's nothing to reconcile here.
+func (a *ISCSIVolumes) ReconcileTags(volume *Volume, desired map[string]string) error {
+	return nil
+}
+
+// AttachVolume logs in to the iSCSI target for the volume and waits for the kernel to expose
+// the resulting block device under /dev/disk/by-path, honoring ctx cancellation while it waits.
+func (a *ISCSIVolumes) AttachVolume(ctx context.Context, volume *Volume) error {
+	manifest, err := a.source.LoadManifest()
+	if err != nil {
+		return err
+	}
+
+	var entry *ISCSIVolumeEntry
+	for i := range manifest.Volumes {
+		if manifest.Volumes[i].VolumeID == volume.ID {
+			entry = &manifest.Volumes[i]
+			break
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("volume %q not found in iscsi manifest", volume.ID)
+	}
+
+	devicePath := iscsiByPathDevice(*entry)
+
+	if _, err := os.Stat(devicePath); err == nil {
+		volume.LocalDevice = devicePath
+		return nil
+	}
+
+	args := []string{"-m", "node", "-T", entry.TargetIQN, "-p", entry.TargetPortal, "--login"}
+	cmd := execCommand("iscsiadm", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error logging in to iscsi target %q via %q: %v: %s", entry.TargetIQN, entry.TargetPortal, err, string(output))
+	}
+
+	deadline := time.Now().Add(a.attachTimeout)
+	for {
+		if _, err := os.Stat(devicePath); err == nil {
+			volume.LocalDevice = devicePath
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %q did not appear after iscsi login for volume %q", ErrAttachTimeout, devicePath, volume.ID)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// byPathDir is a var so tests can point it at a scratch directory instead of /dev/disk/by-path
+var byPathDir = "/dev/disk/by-path"
+
+// iscsiByPathDevice returns the /dev/disk/by-path device name the kernel creates for an
+// iSCSI-attached LUN, of the form ip-<portal>-iscsi-<iqn>-lun-<lun>
+func iscsiByPathDevice(entry ISCSIVolumeEntry) string {
+	name := fmt.Sprintf("ip-%s-iscsi-%s-lun-%d", entry.TargetPortal, entry.TargetIQN, entry.LUN)
+	return filepath.Join(byPathDir, name)
+}
+
+// iscsiManifestPath is set by SetISCSIManifestPath (e.g. from flag parsing in main) before the
+// "iscsi" provider is selected via NewVolumes.
+var iscsiManifestPath string
+
+// SetISCSIManifestPath configures the manifest path the "iscsi" volumes provider will load.
+func SetISCSIManifestPath(path string) {
+	iscsiManifestPath = path
+}
+
+func init() {
+	RegisterVolumeProvider("iscsi", func(config VolumeConfig) (Volumes, error) {
+		if iscsiManifestPath == "" {
+			return nil, fmt.Errorf("iscsi volumes provider requires --iscsi-manifest to be set")
+		}
+		return NewISCSIVolumes(iscsiManifestPath, config)
+	})
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package protokube
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeManifestSource struct {
+	manifest *ISCSIManifest
+}
+
+func (s *fakeManifestSource) LoadManifest() (*ISCSIManifest, error) {
+	return s.manifest, nil
+}
+
+func testManifest() *ISCSIManifest {
+	return &ISCSIManifest{
+		ClusterID:  "test.k8s.local",
+		InternalIP: "192.168.1.10",
+		Volumes: []ISCSIVolumeEntry{
+			{
+				VolumeID:     "vol-1",
+				MasterID:     1,
+				EtcdClusters: map[string]string{"main": "master-1/master-1"},
+				TargetPortal: "192.168.1.100:3260",
+				TargetIQN:    "iqn.2020-01.local.test:etcd-main-1",
+				LUN:          0,
+			},
+		},
+	}
+}
+
+func TestISCSIVolumesFindVolumes(t *testing.T) {
+	byPathDir = t.TempDir()
+	defer func() { byPathDir = "/dev/disk/by-path" }()
+
+	a := &ISCSIVolumes{source: &fakeManifestSource{manifest: testManifest()}}
+
+	volumes, err := a.FindVolumes()
+	if err != nil {
+		t.Fatalf("FindVolumes failed: %v", err)
+	}
+	if len(volumes) != 1 {
+		t.Fatalf("expected 1 volume, got %d", len(volumes))
+	}
+
+	v := volumes[0]
+	if v.ID != "vol-1" {
+		t.Errorf("unexpected volume ID %q", v.ID)
+	}
+	if v.Info.MasterID != 1 {
+		t.Errorf("unexpected master ID %d", v.Info.MasterID)
+	}
+	if len(v.Info.EtcdClusters) != 1 || v.Info.EtcdClusters[0].ClusterKey != "main" {
+		t.Errorf("etcd cluster spec not parsed: %+v", v.Info.EtcdClusters)
+	}
+	if v.Status != "available" {
+		t.Errorf("expected volume to be available, was %q", v.Status)
+	}
+}
+
+// fakeExecCommand is the standard helper-process pattern for stubbing out exec.Command in tests:
+// it re-invokes the test binary with a marker env var so TestHelperProcessISCSIAdm runs instead
+// of the real iscsiadm binary.
+func fakeExecCommand(command string, args ...string) *exec.Cmd {
+	cs := append([]string{"-test.run=TestHelperProcessISCSIAdm", "--", command}, args...)
+	cmd := exec.Command(os.Args[0], cs...)
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	return cmd
+}
+
+func TestHelperProcessISCSIAdm(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	os.Exit(0)
+}
+
+func TestISCSIVolumesAttachVolume(t *testing.T) {
+	byPathDir = t.TempDir()
+	defer func() { byPathDir = "/dev/disk/by-path" }()
+
+	manifest := testManifest()
+	entry := manifest.Volumes[0]
+	devicePath := iscsiByPathDevice(entry)
+
+	// This stub stands in for a successful `iscsiadm ... --login`; since the real
+	// command's only externally-visible effect is making the kernel create the by-path
+	// device, the stub creates that file directly, then runs fakeExecCommand's helper
+	// process in place of the real iscsiadm binary.
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		if err := ioutil.WriteFile(devicePath, []byte{}, 0644); err != nil {
+			t.Fatalf("fake iscsiadm failed to create device: %v", err)
+		}
+		return fakeExecCommand(command, args...)
+	}
+	defer func() { execCommand = exec.Command }()
+
+	a := &ISCSIVolumes{source: &fakeManifestSource{manifest: manifest}, attachTimeout: 5 * time.Second}
+
+	volume := &Volume{ID: entry.VolumeID}
+	if err := a.AttachVolume(context.Background(), volume); err != nil {
+		t.Fatalf("AttachVolume failed: %v", err)
+	}
+
+	if volume.LocalDevice != devicePath {
+		t.Errorf("expected LocalDevice %q, got %q", devicePath, volume.LocalDevice)
+	}
+}
+
+func TestFileManifestSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "manifest.json")
+
+	manifest := testManifest()
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("error marshaling manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatalf("error writing manifest: %v", err)
+	}
+
+	source := &fileManifestSource{path: path}
+	loaded, err := source.LoadManifest()
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if loaded.ClusterID != manifest.ClusterID {
+		t.Errorf("expected clusterID %q, got %q", manifest.ClusterID, loaded.ClusterID)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package protokube
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Volumes is the interface to the cloud-specific volume provider, so that protokube can
+// find and mount the etcd data volumes that belong to this instance
+type Volumes interface {
+	// AttachVolume attaches the specified volume to this instance, setting volume.LocalDevice and
+	// returning nil if successful. It honors ctx cancellation and gives up with ErrAttachTimeout once its own
+	// internal deadline elapses, whichever comes first.
+	AttachVolume(ctx context.Context, volume *Volume) error
+
+	// FindVolumes finds the volumes that are associated with this instance (on AWS, by cluster &
+	// role tags; for iSCSI, from the volume manifest)
+	FindVolumes() ([]*Volume, error)
+
+	// ReconcileTags applies any tags in desired that are missing (or out of date) on volume.
+	// It never removes a tag it doesn't recognize - only tags present in desired are touched.
+	ReconcileTags(volume *Volume, desired map[string]string) error
+
+	// ClusterID returns the cluster id that owns this instance
+	ClusterID() string
+
+	// InternalIP returns the internal IP of the current instance
+	InternalIP() net.IP
+}
+
+// Volume is a volume we have found, together with the state we need to attach/mount it
+type Volume struct {
+	ID          string
+	LocalDevice string
+	AttachedTo  string
+	Status      string
+
+	// AttachedToMultiple lists every instance currently attached to the volume; it is
+	// populated for all volumes, but only meaningful when Info.MultiAttach is true, as
+	// otherwise a volume can only ever have a single attachment.
+	AttachedToMultiple []string
+
+	// VolumeType is the cloud-specific volume type (e.g. gp3, io2); it is surfaced here
+	// (in addition to Info.VolumeType) so that mount/format can choose sensible defaults
+	// without reaching into the Info struct.
+	VolumeType string
+
+	Info VolumeInfo
+}
+
+// VolumeInfo holds the information we need about a volume when attaching / mounting it
+type VolumeInfo struct {
+	Description string
+	MasterID    int
+
+	// VolumeType is the underlying cloud volume type, e.g. gp3, io1, io2, sc1, st1, sbg1, sbp1
+	VolumeType string
+	// IOPS is the provisioned IOPS for the volume, if applicable to the volume type
+	IOPS int64
+	// Throughput is the provisioned throughput (in MiB/s) for the volume, if applicable to the volume type
+	Throughput int64
+
+	// MultiAttach is true if the volume has Multi-Attach enabled (only supported for io2 volumes),
+	// meaning it can be attached to more than one instance in the same AZ at once. Callers that
+	// rely on this are responsible for fencing I/O at a higher layer (e.g. etcd quorum). On AWS a
+	// k8s.io/etcd/<cluster>/multi-attach=false tag turns it off; the tag cannot turn it on.
+	MultiAttach bool
+
+	EtcdClusters []*EtcdClusterSpec
+}
+
+// EtcdClusterSpec is the configuration for an etcd cluster, as parsed from the volume's tags
+type EtcdClusterSpec struct {
+	ClusterKey string
+
+	NodeName  string
+	NodeNames []string
+}
+
+// VolumeConfig is the configuration shared by every Volumes backend, passed in at construction
+// time (via NewVolumes/the registered factory) rather than set afterwards through package-level
+// globals, so that each Volumes instance is independently constructible and testable.
+type VolumeConfig struct {
+	// ReconcileDryRun, if true, makes ReconcileTags log what it would change instead of
+	// actually applying tags.
+	ReconcileDryRun bool
+
+	// AttachTimeout overrides a backend's own default AttachVolume timeout when non-zero.
+	AttachTimeout time.Duration
+}
+
+// VolumeProviderFactory builds a Volumes implementation for a named backend (e.g. "aws", "iscsi")
+type VolumeProviderFactory func(config VolumeConfig) (Volumes, error)
+
+var volumeProvidersMutex sync.Mutex
+var volumeProviders = make(map[string]VolumeProviderFactory)
+
+// RegisterVolumeProvider makes a Volumes backend available under the given name, so that the
+// protokube entrypoint can select it with the --cloud flag.
+func RegisterVolumeProvider(name string, factory VolumeProviderFactory) {
+	volumeProvidersMutex.Lock()
+	defer volumeProvidersMutex.Unlock()
+
+	if _, exists := volumeProviders[name]; exists {
+		panic(fmt.Sprintf("volume provider %q registered twice", name))
+	}
+	volumeProviders[name] = factory
+}
+
+// NewVolumes builds the Volumes implementation registered under the given name (e.g. "aws" or
+// "iscsi"), passing config through to its factory.
+func NewVolumes(name string, config VolumeConfig) (Volumes, error) {
+	volumeProvidersMutex.Lock()
+	factory, ok := volumeProviders[name]
+	volumeProvidersMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown volumes provider %q", name)
+	}
+	return factory(config)
+}
+
+// ParseEtcdClusterSpec parses an etcd cluster spec, as encoded in a volume tag
+func ParseEtcdClusterSpec(key string, v string) (*EtcdClusterSpec, error) {
+	tokens := strings.SplitN(v, "/", 2)
+
+	spec := &EtcdClusterSpec{
+		ClusterKey: key,
+	}
+	spec.NodeName = tokens[0]
+	if len(tokens) == 2 {
+		spec.NodeNames = strings.Split(tokens[1], ",")
+	}
+
+	return spec, nil
+}